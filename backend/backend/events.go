@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const defaultEventRetention = 30 * 24 * time.Hour
+
+// Event kinds recorded via RecordEvent. Named like Passport's
+// "challenges.start" dotted events so kinds stay greppable in storage.
+const (
+	EventLoginOK      = "auth.login.ok"
+	EventLoginFail    = "auth.login.fail"
+	EventUserRegister = "user.register"
+	EventTaskCreate   = "task.create"
+	EventTaskSuggest  = "task.suggest"
+	EventWSConnect    = "ws.connect"
+)
+
+// RecordEvent appends a row to the audit log. userID is 0 for events that
+// happen before a user is known (e.g. a failed login against an unknown
+// username). Failures to record are logged but never fail the calling
+// request — the audit trail must not become a point of failure for the
+// primary business logic.
+func RecordEvent(userID int, kind, target, ip, userAgent string, metadata fiber.Map) {
+	var metaJSON []byte
+	if metadata != nil {
+		metaJSON, _ = json.Marshal(metadata)
+	}
+
+	_, err := dbConnection.Exec(context.Background(),
+		"INSERT INTO events (user_id, kind, target, ip, user_agent, metadata, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		nullableUserID(userID), kind, target, ip, userAgent, metaJSON, time.Now())
+	if err != nil {
+		log.Printf("failed to record event %s: %v", kind, err)
+	}
+}
+
+func nullableUserID(userID int) interface{} {
+	if userID == 0 {
+		return nil
+	}
+	return userID
+}
+
+// AuditEvent mirrors a row of the events table for the admin listing.
+type AuditEvent struct {
+	ID        int             `json:"id"`
+	UserID    *int            `json:"user_id"`
+	Kind      string          `json:"kind"`
+	Target    string          `json:"target"`
+	IP        string          `json:"ip"`
+	UserAgent string          `json:"user_agent"`
+	Metadata  json.RawMessage `json:"metadata"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// listEvents is admin-only and supports filtering by user, kind, and a
+// created_at range via ?user_id=, ?kind=, ?since=, ?until= (RFC3339).
+func listEvents(c *fiber.Ctx) error {
+	query := "SELECT id, user_id, kind, target, ip, user_agent, metadata, created_at FROM events WHERE 1=1"
+	var args []interface{}
+
+	if userIDParam := c.Query("user_id"); userIDParam != "" {
+		userID, err := strconv.Atoi(userIDParam)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid user_id"})
+		}
+		args = append(args, userID)
+		query += " AND user_id=$" + strconv.Itoa(len(args))
+	}
+
+	if kind := c.Query("kind"); kind != "" {
+		args = append(args, kind)
+		query += " AND kind=$" + strconv.Itoa(len(args))
+	}
+
+	if since := c.Query("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid since"})
+		}
+		args = append(args, t)
+		query += " AND created_at >= $" + strconv.Itoa(len(args))
+	}
+
+	if until := c.Query("until"); until != "" {
+		t, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid until"})
+		}
+		args = append(args, t)
+		query += " AND created_at <= $" + strconv.Itoa(len(args))
+	}
+
+	query += " ORDER BY created_at DESC LIMIT 500"
+
+	rows, err := dbConnection.Query(context.Background(), query, args...)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve events"})
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	for rows.Next() {
+		var e AuditEvent
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Kind, &e.Target, &e.IP, &e.UserAgent, &e.Metadata, &e.CreatedAt); err != nil {
+			continue
+		}
+		events = append(events, e)
+	}
+
+	if len(events) == 0 {
+		return c.JSON([]AuditEvent{})
+	}
+	return c.JSON(events)
+}
+
+// startEventPruner periodically deletes events older than the retention
+// window so the audit log doesn't grow unbounded. Retention defaults to 30
+// days and is configurable via EVENT_RETENTION_HOURS.
+func startEventPruner() {
+	retention := defaultEventRetention
+	if hours := os.Getenv("EVENT_RETENTION_HOURS"); hours != "" {
+		if n, err := strconv.Atoi(hours); err == nil && n > 0 {
+			retention = time.Duration(n) * time.Hour
+		}
+	}
+
+	ticker := time.NewTicker(1 * time.Hour)
+	go func() {
+		for range ticker.C {
+			cutoff := time.Now().Add(-retention)
+			tag, err := dbConnection.Exec(context.Background(), "DELETE FROM events WHERE created_at < $1", cutoff)
+			if err != nil {
+				log.Printf("event pruner failed: %v", err)
+				continue
+			}
+			if tag.RowsAffected() > 0 {
+				log.Printf("event pruner removed %d rows older than %s", tag.RowsAffected(), retention)
+			}
+		}
+	}()
+}
@@ -0,0 +1,12 @@
+package main
+
+import "testing"
+
+func TestNullableUserID(t *testing.T) {
+	if v := nullableUserID(0); v != nil {
+		t.Fatalf("expected userID 0 (unknown user) to map to nil, got %v", v)
+	}
+	if v := nullableUserID(42); v != 42 {
+		t.Fatalf("expected a real userID to pass through unchanged, got %v", v)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+const (
+	writeWait     = 10 * time.Second
+	pongWait      = 60 * time.Second
+	pingInterval  = (pongWait * 9) / 10
+	clientSendBuf = 16
+)
+
+// Client is a single authenticated WebSocket connection and the set of
+// topics it is subscribed to (e.g. "tasks", "user:<id>").
+type Client struct {
+	hub    *Hub
+	conn   *websocket.Conn
+	userID int
+	send   chan []byte
+	topics map[string]bool
+}
+
+type topicMessage struct {
+	topic string
+	data  []byte
+}
+
+// Hub owns the set of connected clients and their topic subscriptions.
+// All state is only ever touched from the run() goroutine, so no locking
+// is required.
+type Hub struct {
+	clients    map[*Client]bool
+	topics     map[string]map[*Client]bool
+	register   chan *Client
+	unregister chan *Client
+	broadcast  chan topicMessage
+}
+
+func newHub() *Hub {
+	return &Hub{
+		clients:    make(map[*Client]bool),
+		topics:     make(map[string]map[*Client]bool),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		broadcast:  make(chan topicMessage, 64),
+	}
+}
+
+// run is the hub's single goroutine; start it once with `go hub.run()`.
+func (h *Hub) run() {
+	for {
+		select {
+		case c := <-h.register:
+			h.clients[c] = true
+			for topic := range c.topics {
+				if h.topics[topic] == nil {
+					h.topics[topic] = make(map[*Client]bool)
+				}
+				h.topics[topic][c] = true
+			}
+
+		case c := <-h.unregister:
+			h.dropClient(c)
+
+		case m := <-h.broadcast:
+			for c := range h.topics[m.topic] {
+				select {
+				case c.send <- m.data:
+				default:
+					// Client isn't draining fast enough; drop it rather than
+					// block the hub. Must remove it from every topic it's
+					// subscribed to, not just m.topic, or a later publish to
+					// one of its other topics will send on its closed channel.
+					h.dropClient(c)
+				}
+			}
+		}
+	}
+}
+
+// dropClient removes c from the hub and every topic it's subscribed to, and
+// closes its send channel. Safe to call even if c was already dropped.
+func (h *Hub) dropClient(c *Client) {
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+	delete(h.clients, c)
+	for topic := range c.topics {
+		delete(h.topics[topic], c)
+	}
+	close(c.send)
+}
+
+// Publish marshals v and delivers it to every client subscribed to topic.
+func (h *Hub) Publish(topic string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	h.broadcast <- topicMessage{topic: topic, data: data}
+	return nil
+}
+
+// writePump relays messages queued on the client's send channel to the
+// socket and keeps the connection alive with periodic pings.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingInterval)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readPump drains the socket so pong frames (and the eventual close) are
+// observed; this connection no longer accepts client-sent broadcasts.
+func (c *Client) readPump() {
+	defer func() {
+		c.hub.unregister <- c
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	for {
+		if _, _, err := c.conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+}
+
+// serveWS takes an already-upgraded, authenticated connection, subscribes it to
+// its topics, and starts its pumps. userID comes from the JWT validated
+// during the upgrade handshake in setupWebSocket.
+func serveWS(hub *Hub, conn *websocket.Conn, userID int) {
+	client := &Client{
+		hub:    hub,
+		conn:   conn,
+		userID: userID,
+		send:   make(chan []byte, clientSendBuf),
+		topics: map[string]bool{
+			"tasks":                true,
+			userTopic(userID): true,
+		},
+	}
+
+	hub.register <- client
+
+	go client.writePump()
+	client.readPump()
+}
+
+func userTopic(userID int) string {
+	return "user:" + strconv.Itoa(userID)
+}
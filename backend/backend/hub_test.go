@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestDropClientRemovesFromAllTopics(t *testing.T) {
+	h := newHub()
+	c := &Client{
+		hub:    h,
+		userID: 1,
+		send:   make(chan []byte, clientSendBuf),
+		topics: map[string]bool{"tasks": true, userTopic(1): true},
+	}
+
+	h.clients[c] = true
+	for topic := range c.topics {
+		h.topics[topic] = map[*Client]bool{c: true}
+	}
+
+	h.dropClient(c)
+
+	if _, ok := h.clients[c]; ok {
+		t.Fatal("expected client to be removed from h.clients")
+	}
+	for topic := range c.topics {
+		if _, ok := h.topics[topic][c]; ok {
+			t.Fatalf("expected client to be removed from topic %q", topic)
+		}
+	}
+
+	select {
+	case _, ok := <-c.send:
+		if ok {
+			t.Fatal("expected send channel to be closed")
+		}
+	default:
+		t.Fatal("expected send channel to be closed, not merely empty")
+	}
+}
+
+func TestDropClientIsIdempotent(t *testing.T) {
+	h := newHub()
+	c := &Client{
+		hub:    h,
+		userID: 1,
+		send:   make(chan []byte, clientSendBuf),
+		topics: map[string]bool{"tasks": true},
+	}
+	h.clients[c] = true
+	h.topics["tasks"] = map[*Client]bool{c: true}
+
+	h.dropClient(c)
+
+	// A second drop (e.g. both the broadcast default case and readPump's
+	// deferred unregister racing on the same client) must not panic by
+	// closing an already-closed channel.
+	h.dropClient(c)
+}
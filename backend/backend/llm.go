@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Chunk is one piece of a streamed completion. The final chunk on a
+// successful stream has Done set; a chunk with Err set ends the stream.
+type Chunk struct {
+	Text string
+	Done bool
+	Err  error
+}
+
+// SuggestOptions controls a single completion request.
+type SuggestOptions struct {
+	MaxTokens   int
+	Temperature float64
+}
+
+// LLMProvider abstracts the model backend used by suggestTask so it can be
+// swapped via env var without touching the HTTP handler.
+type LLMProvider interface {
+	Suggest(ctx context.Context, prompt string, opts SuggestOptions) (<-chan Chunk, error)
+}
+
+// newLLMProvider selects a provider implementation based on LLM_PROVIDER
+// (openai, anthropic, ollama). Defaults to openai for backwards compatibility.
+func newLLMProvider() LLMProvider {
+	switch strings.ToLower(os.Getenv("LLM_PROVIDER")) {
+	case "anthropic":
+		return &anthropicProvider{
+			apiKey: os.Getenv("ANTHROPIC_API_KEY"),
+			model:  envOrDefault("ANTHROPIC_MODEL", "claude-3-5-sonnet-latest"),
+			client: &http.Client{},
+		}
+	case "ollama":
+		return &ollamaProvider{
+			baseURL: envOrDefault("OLLAMA_BASE_URL", "http://localhost:11434"),
+			model:   envOrDefault("OLLAMA_MODEL", "llama3"),
+			client:  &http.Client{},
+		}
+	default:
+		return &openAIProvider{
+			apiKey: os.Getenv("OPENAI_API_KEY"),
+			model:  envOrDefault("OPENAI_MODEL", "gpt-4o"),
+			client: &http.Client{},
+		}
+	}
+}
+
+func envOrDefault(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// redactErr ensures an API key never leaks into a handler response or log
+// line by name alone; providers additionally avoid interpolating the key
+// into any error string in the first place.
+func redactErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("llm provider request failed")
+}
+
+// sendChunk delivers chunk on out, or gives up as soon as ctx is done. It
+// reports whether the send happened; a false return means the caller's
+// context was cancelled (e.g. the client disconnected) and the provider
+// goroutine should stop rather than block forever on an unread channel.
+func sendChunk(ctx context.Context, out chan<- Chunk, chunk Chunk) bool {
+	select {
+	case out <- chunk:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// --- OpenAI (chat completions, SSE) -----------------------------------------
+
+type openAIProvider struct {
+	apiKey string
+	model  string
+	client *http.Client
+}
+
+func (p *openAIProvider) Suggest(ctx context.Context, prompt string, opts SuggestOptions) (<-chan Chunk, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"model":       p.model,
+		"stream":      true,
+		"max_tokens":  opts.MaxTokens,
+		"temperature": opts.Temperature,
+		"messages": []map[string]string{
+			{"role": "user", "content": prompt},
+		},
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.openai.com/v1/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, redactErr(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, redactErr(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("openai request failed with status %d", resp.StatusCode)
+	}
+
+	out := make(chan Chunk)
+	go func() {
+		defer close(out)
+		defer resp.Body.Close()
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			data := strings.TrimPrefix(line, "data: ")
+			if data == "[DONE]" {
+				sendChunk(ctx, out, Chunk{Done: true})
+				return
+			}
+
+			var event struct {
+				Choices []struct {
+					Delta struct {
+						Content string `json:"content"`
+					} `json:"delta"`
+				} `json:"choices"`
+			}
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				continue
+			}
+			if len(event.Choices) == 0 {
+				continue
+			}
+			if text := event.Choices[0].Delta.Content; text != "" {
+				if !sendChunk(ctx, out, Chunk{Text: text}) {
+					return
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			sendChunk(ctx, out, Chunk{Err: redactErr(err)})
+		}
+	}()
+
+	return out, nil
+}
+
+// --- Anthropic (messages, SSE) ----------------------------------------------
+
+type anthropicProvider struct {
+	apiKey string
+	model  string
+	client *http.Client
+}
+
+func (p *anthropicProvider) Suggest(ctx context.Context, prompt string, opts SuggestOptions) (<-chan Chunk, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"model":      p.model,
+		"stream":     true,
+		"max_tokens": opts.MaxTokens,
+		"messages": []map[string]string{
+			{"role": "user", "content": prompt},
+		},
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.anthropic.com/v1/messages", bytes.NewReader(body))
+	if err != nil {
+		return nil, redactErr(err)
+	}
+	req.Header.Set("x-api-key", p.apiKey)
+	req.Header.Set("anthropic-version", "2023-06-01")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, redactErr(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("anthropic request failed with status %d", resp.StatusCode)
+	}
+
+	out := make(chan Chunk)
+	go func() {
+		defer close(out)
+		defer resp.Body.Close()
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			data := strings.TrimPrefix(line, "data: ")
+
+			var event struct {
+				Type  string `json:"type"`
+				Delta struct {
+					Text string `json:"text"`
+				} `json:"delta"`
+			}
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				continue
+			}
+
+			switch event.Type {
+			case "content_block_delta":
+				if event.Delta.Text != "" {
+					if !sendChunk(ctx, out, Chunk{Text: event.Delta.Text}) {
+						return
+					}
+				}
+			case "message_stop":
+				sendChunk(ctx, out, Chunk{Done: true})
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			sendChunk(ctx, out, Chunk{Err: redactErr(err)})
+		}
+	}()
+
+	return out, nil
+}
+
+// --- Ollama (local, NDJSON) --------------------------------------------------
+
+type ollamaProvider struct {
+	baseURL string
+	model   string
+	client  *http.Client
+}
+
+func (p *ollamaProvider) Suggest(ctx context.Context, prompt string, opts SuggestOptions) (<-chan Chunk, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"model":  p.model,
+		"prompt": prompt,
+		"stream": true,
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/api/generate", bytes.NewReader(body))
+	if err != nil {
+		return nil, redactErr(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, redactErr(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("ollama request failed with status %d", resp.StatusCode)
+	}
+
+	out := make(chan Chunk)
+	go func() {
+		defer close(out)
+		defer resp.Body.Close()
+
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			var event struct {
+				Response string `json:"response"`
+				Done     bool   `json:"done"`
+			}
+			if err := decoder.Decode(&event); err != nil {
+				break
+			}
+			if event.Response != "" {
+				if !sendChunk(ctx, out, Chunk{Text: event.Response}) {
+					return
+				}
+			}
+			if event.Done {
+				sendChunk(ctx, out, Chunk{Done: true})
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// suggestTimeout bounds how long a single suggestion request may stream for.
+const suggestTimeout = 30 * time.Second
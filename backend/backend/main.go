@@ -1,12 +1,10 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"context"
-	"encoding/json" // ✅ Required for JSON parsing
 	"fmt"
 	"log"
-	"net/http" // ✅ Required for HTTP requests
 	"os"
 	"time"
 
@@ -15,36 +13,39 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/websocket/v2"
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/v4"
 	"github.com/joho/godotenv"
 )
 
 var jwtSecret = []byte(os.Getenv("JWT_SECRET"))
 var dbConnection *pgx.Conn
-var clients = make(map[*websocket.Conn]bool) // Store connected WebSocket clients
+var hub = newHub()
+var llmProvider = newLLMProvider()
 
 // User struct represents a user in the database
 type User struct {
 	ID       int    `json:"id"`
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Role     string `json:"role"`
 }
 
+const (
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
 // Task struct represents a task in the database
 type Task struct {
 	ID        int       `json:"id"`
 	Title     string    `json:"title"`
 	Assigned  string    `json:"assigned"`
 	Status    string    `json:"status"`
+	CreatedBy int       `json:"created_by"`
 	CreatedAt time.Time `json:"created_at"`
 }
 
-// LoginRequest struct for login requests
-type LoginRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-}
-
 func main() {
 	// Load environment variables
 	err := godotenv.Load()
@@ -64,14 +65,23 @@ func main() {
 	app.Use(logger.New())
 
 	// ✅ Setup WebSockets
+	go hub.run()
 	setupWebSocket(app)
 
+	startEventPruner()
+
 	// API Routes
 	app.Post("/register", registerUser)
-	app.Post("/login", LoginHandler)
-	app.Post("/task", createTask)
-	app.Get("/tasks", getTasks)
-	app.Post("/task/suggest", suggestTask) // ✅ Added missing suggestTask route
+	app.Post("/auth", doAuthenticate)                // Step 1: username + password -> ticket (or token if no MFA enrolled)
+	app.Post("/auth/mfa", doMultiFactorAuthenticate) // Step 2: ticket + factor code -> token
+	app.Post("/auth/factors", AuthMiddleware, enrollFactor)
+	app.Get("/auth/factors", AuthMiddleware, listFactorsHandler)
+	app.Delete("/auth/factors/:id", AuthMiddleware, deleteFactorHandler)
+	app.Post("/logout", AuthMiddleware, logoutHandler)
+	app.Post("/task", AuthMiddleware, createTask)
+	app.Get("/tasks", AuthMiddleware, getTasks)
+	app.Post("/task/suggest", AuthMiddleware, RequireRole(RoleMember, RoleAdmin), suggestTask) // ✅ Added missing suggestTask route
+	app.Get("/events", AuthMiddleware, RequireRole(RoleAdmin), listEvents)
 
 	// Start server
 	log.Fatal(app.Listen(":8080"))
@@ -79,53 +89,53 @@ func main() {
 
 // Register a new user
 func registerUser(c *fiber.Ctx) error {
-	var user User
-	if err := c.BodyParser(&user); err != nil {
+	var req RegisterRequest
+	if err := c.BodyParser(&req); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
 
-	_, err := dbConnection.Exec(context.Background(),
-		"INSERT INTO users (username, password) VALUES ($1, $2)",
-		user.Username, user.Password)
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to register user"})
+	if err := validate.Struct(req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid username or password: " + err.Error()})
 	}
 
-	return c.JSON(fiber.Map{"message": "User registered successfully"})
-}
-
-// Login handler with JWT authentication
-func LoginHandler(c *fiber.Ctx) error {
-	var req LoginRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Bad request"})
+	hashed, err := HashPassword(req.Password)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to register user"})
 	}
 
-	user, err := GetUserFromDB(req.Username)
+	_, err = dbConnection.Exec(context.Background(),
+		"INSERT INTO users (username, password, role) VALUES ($1, $2, $3)",
+		req.Username, hashed, RoleMember)
 	if err != nil {
-		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to register user"})
 	}
 
-	// Validate password
-	if user.Password != req.Password {
-		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
-	}
+	RecordEvent(0, EventUserRegister, req.Username, c.IP(), c.Get("User-Agent"), nil)
+
+	return c.JSON(fiber.Map{"message": "User registered successfully"})
+}
+
+// Fetch user from database
+func GetUserFromDB(username string) (User, error) {
+	var user User
+	err := dbConnection.QueryRow(context.Background(),
+		"SELECT id, username, password, role FROM users WHERE username=$1", username).
+		Scan(&user.ID, &user.Username, &user.Password, &user.Role)
 
-	// Generate JWT Token
-	token, err := GenerateJWT(user)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to generate token"})
+		return User{}, err
 	}
 
-	return c.JSON(fiber.Map{"token": token})
+	return user, nil
 }
 
-// Fetch user from database
-func GetUserFromDB(username string) (User, error) {
+// GetUserByID fetches a user by primary key, used once a ticket's factors
+// have all been satisfied and it's time to mint the final token.
+func GetUserByID(id int) (User, error) {
 	var user User
 	err := dbConnection.QueryRow(context.Background(),
-		"SELECT id, username, password FROM users WHERE username=$1", username).
-		Scan(&user.ID, &user.Username, &user.Password)
+		"SELECT id, username, password, role FROM users WHERE id=$1", id).
+		Scan(&user.ID, &user.Username, &user.Password, &user.Role)
 
 	if err != nil {
 		return User{}, err
@@ -140,6 +150,8 @@ func GenerateJWT(user User) (string, error) {
 	claims := token.Claims.(jwt.MapClaims)
 	claims["user_id"] = user.ID
 	claims["username"] = user.Username
+	claims["role"] = user.Role
+	claims["jti"] = uuid.NewString()
 	claims["exp"] = time.Now().Add(time.Hour * 24).Unix()
 
 	t, err := token.SignedString(jwtSecret)
@@ -150,16 +162,22 @@ func GenerateJWT(user User) (string, error) {
 	return t, nil
 }
 
-// Create a new task
+// Create a new task. created_by and assigned always come from the caller's
+// claims, never from the request body, so a user can't forge authorship or
+// plant a task in another user's list.
 func createTask(c *fiber.Ctx) error {
+	claims := getClaims(c)
+
 	var task Task
 	if err := c.BodyParser(&task); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
+	task.CreatedBy = claims.UserID
+	task.Assigned = claims.Username
 
 	_, err := dbConnection.Exec(context.Background(),
-		"INSERT INTO tasks (title, assigned, status, created_at) VALUES ($1, $2, $3, $4)",
-		task.Title, task.Assigned, task.Status, time.Now())
+		"INSERT INTO tasks (title, assigned, status, created_by, created_at) VALUES ($1, $2, $3, $4, $5)",
+		task.Title, task.Assigned, task.Status, task.CreatedBy, time.Now())
 
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to create task"})
@@ -167,12 +185,25 @@ func createTask(c *fiber.Ctx) error {
 
 	broadcastTaskUpdate(task) // ✅ Broadcast task update via WebSocket
 
+	RecordEvent(claims.UserID, EventTaskCreate, task.Title, c.IP(), c.Get("User-Agent"), nil)
+
 	return c.JSON(fiber.Map{"message": "Task created successfully"})
 }
 
-// Retrieve all tasks
+// Retrieve tasks the caller owns or is assigned to; admins see everything.
 func getTasks(c *fiber.Ctx) error {
-	rows, err := dbConnection.Query(context.Background(), "SELECT id, title, assigned, status, created_at FROM tasks")
+	claims := getClaims(c)
+
+	var rows pgx.Rows
+	var err error
+	if claims.Role == RoleAdmin {
+		rows, err = dbConnection.Query(context.Background(),
+			"SELECT id, title, assigned, status, created_by, created_at FROM tasks")
+	} else {
+		rows, err = dbConnection.Query(context.Background(),
+			"SELECT id, title, assigned, status, created_by, created_at FROM tasks WHERE created_by=$1 OR assigned=$2",
+			claims.UserID, claims.Username)
+	}
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve tasks"})
 	}
@@ -181,15 +212,13 @@ func getTasks(c *fiber.Ctx) error {
 	var tasks []Task
 	for rows.Next() {
 		var task Task
-		err := rows.Scan(&task.ID, &task.Title, &task.Assigned, &task.Status, &task.CreatedAt)
+		err := rows.Scan(&task.ID, &task.Title, &task.Assigned, &task.Status, &task.CreatedBy, &task.CreatedAt)
 		if err != nil {
 			continue
 		}
 		tasks = append(tasks, task)
 	}
 
-	fmt.Println("Returning tasks:", tasks) // ✅ Debugging log
-
 	// ✅ Return an empty array instead of `null`
 	if len(tasks) == 0 {
 		return c.JSON([]Task{})
@@ -200,94 +229,114 @@ func getTasks(c *fiber.Ctx) error {
 
 // WebSocket setup
 func setupWebSocket(app *fiber.App) {
-	app.Get("/ws", websocket.New(func(c *websocket.Conn) {
-		clients[c] = true
-		defer func() {
-			delete(clients, c)
-			c.Close()
-		}()
-
-		for {
-			messageType, msg, err := c.ReadMessage()
-			if err != nil {
-				break
-			}
+	// Require a valid JWT before upgrading: either ?token=... on the query
+	// string or the Sec-WebSocket-Protocol header, since browsers can't set
+	// arbitrary headers on a WebSocket handshake.
+	app.Use("/ws", func(c *fiber.Ctx) error {
+		if !websocket.IsWebSocketUpgrade(c) {
+			return fiber.ErrUpgradeRequired
+		}
 
-			for client := range clients {
-				if err := client.WriteMessage(messageType, msg); err != nil {
-					delete(clients, client)
-					client.Close()
-				}
-			}
+		raw := c.Query("token")
+		if raw == "" {
+			raw = c.Get("Sec-WebSocket-Protocol")
+		}
+
+		token, err := jwt.Parse(raw, hmacKeyFunc)
+		if err != nil || !token.Valid {
+			return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+		}
+
+		claims, ok := token.Claims.(jwt.MapClaims)
+		if !ok {
+			return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+		}
+
+		userID, ok := claims["user_id"].(float64)
+		if !ok {
+			return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
 		}
+
+		c.Locals("userID", int(userID))
+		c.Locals("userAgent", c.Get("User-Agent"))
+		return c.Next()
+	})
+
+	app.Get("/ws", websocket.New(func(c *websocket.Conn) {
+		userID, _ := c.Locals("userID").(int)
+		userAgent, _ := c.Locals("userAgent").(string)
+		RecordEvent(userID, EventWSConnect, "", c.RemoteAddr().String(), userAgent, nil)
+		serveWS(hub, c, userID)
 	}))
 }
 
-// Broadcast task updates to WebSocket clients
+// broadcastTaskUpdate publishes a task change to every client subscribed to
+// the "tasks" topic via the hub, rather than writing to sockets directly.
 func broadcastTaskUpdate(task Task) {
-	for client := range clients {
-		err := client.WriteJSON(task)
-		if err != nil {
-			delete(clients, client)
-			client.Close()
-		}
+	if err := hub.Publish("tasks", task); err != nil {
+		log.Printf("failed to publish task update: %v", err)
 	}
 }
+
+// suggestTask streams an AI task suggestion back to the caller. Tokens are
+// pushed to the caller's "user:<id>" hub topic as they arrive and also
+// flushed as an SSE response, so either a connected WebSocket client or the
+// HTTP caller itself can consume the stream.
 func suggestTask(c *fiber.Ctx) error {
+	claims := getClaims(c)
+
+	if !suggestLimiter.Allow(claims.UserID) {
+		return c.Status(429).JSON(fiber.Map{"error": "Rate limit exceeded, try again shortly"})
+	}
+
 	var req struct {
 		Prompt string `json:"prompt"`
 	}
-
 	if err := c.BodyParser(&req); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
 
-	openaiAPIKey := os.Getenv("OPENAI_API_KEY")
-	response, err := callOpenAI(req.Prompt, openaiAPIKey)
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to get AI suggestions"})
-	}
+	// The stream writer below runs after this handler returns, so it owns
+	// cancel; cancelling here on return would cut the stream off.
+	ctx, cancel := context.WithTimeout(context.Background(), suggestTimeout)
 
-	return c.JSON(fiber.Map{"suggestion": response})
-}
-func callOpenAI(prompt string, apiKey string) (string, error) {
-	url := "https://api.openai.com/v1/completions"
-	data := map[string]interface{}{
-		"model":      "gpt-4",
-		"prompt":     prompt,
-		"max_tokens": 100,
-	}
-	jsonData, _ := json.Marshal(data)
+	RecordEvent(claims.UserID, EventTaskSuggest, req.Prompt, c.IP(), c.Get("User-Agent"), nil)
 
-	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	stream, err := llmProvider.Suggest(ctx, req.Prompt, SuggestOptions{MaxTokens: 256, Temperature: 0.7})
 	if err != nil {
-		return "", err
+		cancel()
+		log.Printf("llm suggest failed for user %d: %v", claims.UserID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get AI suggestions"})
 	}
-	defer resp.Body.Close()
 
-	var res map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&res)
+	topic := userTopic(claims.UserID)
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer cancel()
+		for chunk := range stream {
+			if chunk.Err != nil {
+				log.Printf("llm stream error for user %d: %v", claims.UserID, chunk.Err)
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", chunk.Err.Error())
+				w.Flush()
+				return
+			}
 
-	// ✅ Safely extract the text response
-	choices, ok := res["choices"].([]interface{})
-	if !ok || len(choices) == 0 {
-		return "", fmt.Errorf("invalid response from OpenAI")
-	}
+			hub.Publish(topic, fiber.Map{"suggestion": chunk.Text, "done": chunk.Done})
 
-	choice, ok := choices[0].(map[string]interface{})
-	if !ok {
-		return "", fmt.Errorf("invalid response structure")
-	}
+			if chunk.Done {
+				fmt.Fprintf(w, "data: [DONE]\n\n")
+				w.Flush()
+				return
+			}
 
-	text, ok := choice["text"].(string)
-	if !ok {
-		return "", fmt.Errorf("text not found in response")
-	}
+			fmt.Fprintf(w, "data: %s\n\n", chunk.Text)
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	})
 
-	return text, nil
+	return nil
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+)
+
+func TestVerifyFactorCodeTOTP(t *testing.T) {
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: issuerName, AccountName: "alice"})
+	if err != nil {
+		t.Fatalf("totp.Generate: %v", err)
+	}
+	factor := AuthFactor{Type: factorTypeTOTP, Secret: key.Secret()}
+
+	code, err := totp.GenerateCode(factor.Secret, time.Now())
+	if err != nil {
+		t.Fatalf("totp.GenerateCode: %v", err)
+	}
+	if err := verifyFactorCode(factor, code); err != nil {
+		t.Fatalf("expected a freshly generated TOTP code to verify, got: %v", err)
+	}
+
+	if err := verifyFactorCode(factor, "000000"); err == nil {
+		t.Fatal("expected an arbitrary code to fail TOTP verification")
+	}
+}
+
+func TestVerifyFactorCodeEmailAndBackup(t *testing.T) {
+	for _, typ := range []string{factorTypeEmail, factorTypeBackup} {
+		factor := AuthFactor{Type: typ, Secret: "ABCDE12345"}
+
+		if err := verifyFactorCode(factor, "ABCDE12345"); err != nil {
+			t.Fatalf("%s: expected matching code to verify, got: %v", typ, err)
+		}
+		if err := verifyFactorCode(factor, " ABCDE12345 "); err != nil {
+			t.Fatalf("%s: expected surrounding whitespace to be trimmed, got: %v", typ, err)
+		}
+		if err := verifyFactorCode(factor, "WRONGCODE1"); err == nil {
+			t.Fatalf("%s: expected mismatched code to fail", typ)
+		}
+	}
+}
+
+func TestVerifyFactorCodeUnsupportedType(t *testing.T) {
+	factor := AuthFactor{Type: "carrier_pigeon", Secret: "x"}
+	if err := verifyFactorCode(factor, "x"); err == nil {
+		t.Fatal("expected an unrecognized factor type to be rejected")
+	}
+}
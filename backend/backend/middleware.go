@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const claimsLocalsKey = "claims"
+
+// hmacKeyFunc is the jwt.Keyfunc used everywhere we verify a token signed by
+// GenerateJWT. It rejects anything not signed with an HMAC method (HS256,
+// HS384 or HS512, all keyed by jwtSecret) so a token crafted
+// with alg "none" or an asymmetric algorithm can never be accepted just
+// because the library handed back jwtSecret for it.
+func hmacKeyFunc(t *jwt.Token) (interface{}, error) {
+	if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+	}
+	return jwtSecret, nil
+}
+
+// AuthClaims is the decoded identity carried by a request's bearer token.
+type AuthClaims struct {
+	UserID   int
+	Username string
+	Role     string
+	JTI      string
+}
+
+// AuthMiddleware parses and validates the Authorization: Bearer header,
+// checks exp and the revocation list, and injects the caller's identity
+// into c.Locals for downstream handlers.
+func AuthMiddleware(c *fiber.Ctx) error {
+	header := c.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return c.Status(401).JSON(fiber.Map{"error": "Missing bearer token"})
+	}
+	raw := strings.TrimPrefix(header, "Bearer ")
+
+	token, err := jwt.Parse(raw, hmacKeyFunc)
+	if err != nil || !token.Valid {
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid or expired token"})
+	}
+
+	mapClaims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	userID, ok := mapClaims["user_id"].(float64)
+	if !ok {
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+	jti, _ := mapClaims["jti"].(string)
+
+	if jti != "" {
+		revoked, err := isTokenRevoked(jti)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to validate token"})
+		}
+		if revoked {
+			return c.Status(401).JSON(fiber.Map{"error": "Token has been revoked"})
+		}
+	}
+
+	username, _ := mapClaims["username"].(string)
+	role, _ := mapClaims["role"].(string)
+
+	c.Locals(claimsLocalsKey, AuthClaims{
+		UserID:   int(userID),
+		Username: username,
+		Role:     role,
+		JTI:      jti,
+	})
+	return c.Next()
+}
+
+// getClaims returns the identity AuthMiddleware attached to c. Only safe to
+// call from handlers mounted behind AuthMiddleware.
+func getClaims(c *fiber.Ctx) AuthClaims {
+	claims, _ := c.Locals(claimsLocalsKey).(AuthClaims)
+	return claims
+}
+
+// RequireRole gates a route to callers whose JWT role claim is one of roles.
+// Must run after AuthMiddleware.
+func RequireRole(roles ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		claims := getClaims(c)
+		for _, role := range roles {
+			if claims.Role == role {
+				return c.Next()
+			}
+		}
+		return c.Status(403).JSON(fiber.Map{"error": "Forbidden"})
+	}
+}
+
+// isTokenRevoked reports whether jti appears in the Postgres-backed
+// revocation list, i.e. the token was explicitly logged out before its exp.
+func isTokenRevoked(jti string) (bool, error) {
+	var exists bool
+	err := dbConnection.QueryRow(context.Background(),
+		"SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE jti=$1)", jti).Scan(&exists)
+	return exists, err
+}
+
+// revokeToken records jti as revoked until expiresAt, at which point it
+// would have expired naturally anyway.
+func revokeToken(jti string, expiresAt time.Time) error {
+	_, err := dbConnection.Exec(context.Background(),
+		"INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING",
+		jti, expiresAt)
+	return err
+}
+
+// logoutHandler revokes the caller's current token so it can't be reused
+// before its natural exp, even though the server itself holds no session.
+func logoutHandler(c *fiber.Ctx) error {
+	claims := getClaims(c)
+	if claims.JTI == "" {
+		return c.JSON(fiber.Map{"message": "Logged out"})
+	}
+
+	if err := revokeToken(claims.JTI, time.Now().Add(24*time.Hour)); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to log out"})
+	}
+	return c.JSON(fiber.Map{"message": "Logged out"})
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestHmacKeyFuncAcceptsHMAC(t *testing.T) {
+	token := jwt.New(jwt.SigningMethodHS256)
+	key, err := hmacKeyFunc(token)
+	if err != nil {
+		t.Fatalf("expected HS256 token to be accepted, got: %v", err)
+	}
+	if string(key.([]byte)) != string(jwtSecret) {
+		t.Fatal("expected hmacKeyFunc to return jwtSecret")
+	}
+}
+
+func TestHmacKeyFuncRejectsNonHMAC(t *testing.T) {
+	token := jwt.New(jwt.SigningMethodRS256)
+	if _, err := hmacKeyFunc(token); err == nil {
+		t.Fatal("expected a non-HMAC signing method to be rejected")
+	}
+}
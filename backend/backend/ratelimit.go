@@ -0,0 +1,37 @@
+package main
+
+import (
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	suggestRatePerSecond = 0.5 // one suggestion every 2s, sustained
+	suggestBurst         = 3
+)
+
+// perUserLimiter hands out a token-bucket rate.Limiter per authenticated
+// user so one account can't monopolize the upstream LLM quota.
+type perUserLimiter struct {
+	mu       sync.Mutex
+	limiters map[int]*rate.Limiter
+}
+
+func newPerUserLimiter() *perUserLimiter {
+	return &perUserLimiter{limiters: make(map[int]*rate.Limiter)}
+}
+
+func (p *perUserLimiter) Allow(userID int) bool {
+	p.mu.Lock()
+	limiter, ok := p.limiters[userID]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(suggestRatePerSecond), suggestBurst)
+		p.limiters[userID] = limiter
+	}
+	p.mu.Unlock()
+
+	return limiter.Allow()
+}
+
+var suggestLimiter = newPerUserLimiter()
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var validate = validator.New()
+
+// RegisterRequest is the validated payload for new account creation.
+type RegisterRequest struct {
+	Username string `json:"username" validate:"required,min=3,max=32,alphanum"`
+	Password string `json:"password" validate:"required,min=8,max=72"`
+}
+
+// HashPassword bcrypt-hashes a plaintext password for storage.
+func HashPassword(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+// isBcryptHash reports whether stored looks like a bcrypt hash as opposed to
+// a legacy plaintext password. Legacy rows predate bcrypt adoption and need
+// to be rehashed on first successful login.
+func isBcryptHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") ||
+		strings.HasPrefix(stored, "$2b$") ||
+		strings.HasPrefix(stored, "$2y$")
+}
+
+// verifyPassword checks password against stored, transparently handling
+// legacy plaintext rows. It reports whether the password matched and
+// whether stored still needs to be rehashed to bcrypt.
+func verifyPassword(password, stored string) (ok bool, needsRehash bool) {
+	if !isBcryptHash(stored) {
+		return password == stored, password == stored
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(password))
+	return err == nil, false
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestVerifyPasswordLegacyPlaintext(t *testing.T) {
+	ok, needsRehash := verifyPassword("hunter2", "hunter2")
+	if !ok {
+		t.Fatal("expected legacy plaintext password to match")
+	}
+	if !needsRehash {
+		t.Fatal("expected legacy plaintext password to be flagged for rehash")
+	}
+
+	ok, needsRehash = verifyPassword("wrong", "hunter2")
+	if ok {
+		t.Fatal("expected mismatched legacy plaintext password to fail")
+	}
+	if needsRehash {
+		t.Fatal("a failed match shouldn't be flagged for rehash")
+	}
+}
+
+func TestVerifyPasswordBcrypt(t *testing.T) {
+	hashed, err := HashPassword("hunter2")
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+
+	ok, needsRehash := verifyPassword("hunter2", hashed)
+	if !ok {
+		t.Fatal("expected bcrypt hash to match its plaintext")
+	}
+	if needsRehash {
+		t.Fatal("an up-to-date bcrypt hash shouldn't be flagged for rehash")
+	}
+
+	ok, _ = verifyPassword("wrong", hashed)
+	if ok {
+		t.Fatal("expected mismatched password to fail against bcrypt hash")
+	}
+}